@@ -2,6 +2,9 @@ package quic
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"fmt"
 	"net"
@@ -13,6 +16,10 @@ import (
 	"github.com/lucas-clemente/quic-go/internal/wire"
 )
 
+// minStatelessResetPayloadSize is the number of random "pseudo packet number/payload"
+// bytes placed before the 16-byte reset token, per RFC 9000 section 10.3.
+const minStatelessResetPayloadSize = 5
+
 type packetHandlerEntry struct {
 	handler    packetHandler
 	resetToken *[16]byte
@@ -35,24 +42,48 @@ type packetHandlerMap struct {
 
 	deleteRetiredSessionsAfter time.Duration
 
+	statelessResetKey []byte
+
+	sentResetTokensMu sync.Mutex
+	sentResetTokens   map[[16]byte] /* stateless reset token */ struct{}
+
 	logger utils.Logger
 }
 
 var _ packetHandlerManager = &packetHandlerMap{}
 
-func newPacketHandlerMap(conn net.PacketConn, connIDLen int, logger utils.Logger) packetHandlerManager {
+func newPacketHandlerMap(conn net.PacketConn, connIDLen int, statelessResetKey []byte, logger utils.Logger) packetHandlerManager {
 	m := &packetHandlerMap{
 		conn:                       conn,
 		connIDLen:                  connIDLen,
 		handlers:                   make(map[string]packetHandlerEntry),
 		resetTokens:                make(map[[16]byte]packetHandler),
+		sentResetTokens:            make(map[[16]byte]struct{}),
 		deleteRetiredSessionsAfter: protocol.RetiredConnectionIDDeleteTimeout,
+		statelessResetKey:          statelessResetKey,
 		logger:                     logger,
 	}
 	go m.listen()
 	return m
 }
 
+// GetStatelessResetToken derives the stateless reset token for id as HMAC-SHA256(key,
+// id)[:16], so the token advertised in a NEW_CONNECTION_ID frame for id always matches
+// the one handlePacket would emit if a peer later sends a short-header packet for it
+// after we've lost the session. Without a configured key, tokens are random and this
+// endpoint can't usefully reset connections it no longer remembers.
+func (h *packetHandlerMap) GetStatelessResetToken(id protocol.ConnectionID) [16]byte {
+	var token [16]byte
+	if len(h.statelessResetKey) == 0 {
+		rand.Read(token[:])
+		return token
+	}
+	mac := hmac.New(sha256.New, h.statelessResetKey)
+	mac.Write(id.Bytes())
+	copy(token[:], mac.Sum(nil))
+	return token
+}
+
 func (h *packetHandlerMap) Add(id protocol.ConnectionID, handler packetHandler) {
 	h.mutex.Lock()
 	h.handlers[string(id)] = packetHandlerEntry{handler: handler}
@@ -142,6 +173,59 @@ func (h *packetHandlerMap) close(e error) error {
 	return nil
 }
 
+// statelessResetEchoWindow bounds how long we remember a token passed to
+// maybeSendStatelessReset, so isOurSentResetToken can recognize that reset if it echoes
+// back to us (e.g. a NAT or middlebox reflecting it) before two endpoints that have both
+// lost state end up replying to each other's resets indefinitely.
+const statelessResetEchoWindow = 5 * time.Second
+
+// rememberSentResetToken records token as one we've just sent a stateless reset with,
+// forgetting it again after statelessResetEchoWindow.
+func (h *packetHandlerMap) rememberSentResetToken(token [16]byte) {
+	h.sentResetTokensMu.Lock()
+	h.sentResetTokens[token] = struct{}{}
+	h.sentResetTokensMu.Unlock()
+	time.AfterFunc(statelessResetEchoWindow, func() {
+		h.sentResetTokensMu.Lock()
+		delete(h.sentResetTokens, token)
+		h.sentResetTokensMu.Unlock()
+	})
+}
+
+// isOurSentResetToken reports whether token matches a stateless reset we sent within the
+// last statelessResetEchoWindow. A reset we generate embeds this token in its trailing 16
+// bytes, but its leading bytes are random and unrelated to any connection ID, so this is
+// the only way to recognize our own reset coming back to us.
+func (h *packetHandlerMap) isOurSentResetToken(token [16]byte) bool {
+	h.sentResetTokensMu.Lock()
+	defer h.sentResetTokensMu.Unlock()
+	_, ok := h.sentResetTokens[token]
+	return ok
+}
+
+// maybeSendStatelessReset replies to an unroutable short-header packet with a stateless
+// reset carrying token, per RFC 9000 section 10.3. The reply is kept shorter than
+// receivedLen to avoid being usable as an amplification vector; if there isn't room for
+// a plausibly-sized reset, it silently does nothing.
+func (h *packetHandlerMap) maybeSendStatelessReset(addr net.Addr, token [16]byte, receivedLen int) {
+	maxTotal := receivedLen - 1
+	if maxTotal < minStatelessResetPayloadSize+16 {
+		return
+	}
+	buf := make([]byte, 1+minStatelessResetPayloadSize+16)
+	if _, err := rand.Read(buf[:1+minStatelessResetPayloadSize]); err != nil {
+		return
+	}
+	// Header form bit (0x80) cleared, fixed bit (0x40) set; the rest can be random.
+	buf[0] = 0x40 | (buf[0] &^ 0x80)
+	copy(buf[1+minStatelessResetPayloadSize:], token[:])
+	if len(buf) >= receivedLen {
+		return
+	}
+	h.rememberSentResetToken(token)
+	h.conn.WriteTo(buf, addr)
+}
+
 func (h *packetHandlerMap) listen() {
 	for {
 		data := *getPacketBuffer()
@@ -161,6 +245,21 @@ func (h *packetHandlerMap) listen() {
 	}
 }
 
+// resolveHandlePacket looks up the handler registered for connID, falling back to
+// fallback if none is found. It's used to re-check h.handlers for each packet in a
+// coalesced datagram: the first packet of a new connection is dispatched via
+// server.handlePacket (fallback), and handling it can register a session in
+// h.handlers before the next coalesced packet is processed, which should then go to
+// that session rather than through the generic new-connection path a second time.
+func (h *packetHandlerMap) resolveHandlePacket(connID protocol.ConnectionID, fallback func(*receivedPacket)) func(*receivedPacket) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if entry, ok := h.handlers[string(connID)]; ok {
+		return entry.handler.handlePacket
+	}
+	return fallback
+}
+
 func (h *packetHandlerMap) handlePacket(addr net.Addr, data []byte) error {
 	rcvTime := time.Now()
 
@@ -194,8 +293,13 @@ func (h *packetHandlerMap) handlePacket(addr net.Addr, data []byte) error {
 					sess.destroy(errors.New("received a stateless reset"))
 					return nil
 				}
+				// Never reply to what looks like our own reset: that would set up a
+				// reset-generation loop between two endpoints that both lost state.
+				if !h.isOurSentResetToken(token) {
+					h.maybeSendStatelessReset(addr, h.GetStatelessResetToken(iHdr.DestConnectionID), len(data))
+				}
 			}
-			// TODO(#943): send a stateless reset
+			h.mutex.RUnlock()
 			return fmt.Errorf("received a short header packet with an unexpected connection ID %s", iHdr.DestConnectionID)
 		}
 		if server == nil { // no server set
@@ -215,22 +319,83 @@ func (h *packetHandlerMap) handlePacket(addr net.Addr, data []byte) error {
 	hdr.Raw = data[:len(data)-r.Len()]
 	packetData := data[len(data)-r.Len():]
 
-	if hdr.IsLongHeader {
-		if hdr.Length < protocol.ByteCount(hdr.PacketNumberLen) {
-			return fmt.Errorf("packet length (%d bytes) shorter than packet number (%d bytes)", hdr.Length, hdr.PacketNumberLen)
-		}
-		if protocol.ByteCount(len(packetData))+protocol.ByteCount(hdr.PacketNumberLen) < hdr.Length {
-			return fmt.Errorf("packet length (%d bytes) is smaller than the expected length (%d bytes)", len(packetData)+int(hdr.PacketNumberLen), hdr.Length)
-		}
-		packetData = packetData[:int(hdr.Length)-int(hdr.PacketNumberLen)]
-		// TODO(#1312): implement parsing of compound packets
+	if !hdr.IsLongHeader {
+		handlePacket(&receivedPacket{
+			remoteAddr: addr,
+			header:     hdr,
+			data:       packetData,
+			rcvTime:    rcvTime,
+		})
+		return nil
 	}
 
+	if hdr.Length < protocol.ByteCount(hdr.PacketNumberLen) {
+		return fmt.Errorf("packet length (%d bytes) shorter than packet number (%d bytes)", hdr.Length, hdr.PacketNumberLen)
+	}
+	if protocol.ByteCount(len(packetData))+protocol.ByteCount(hdr.PacketNumberLen) < hdr.Length {
+		return fmt.Errorf("packet length (%d bytes) is smaller than the expected length (%d bytes)", len(packetData)+int(hdr.PacketNumberLen), hdr.Length)
+	}
+	rest := packetData[int(hdr.Length)-int(hdr.PacketNumberLen):]
+	packetData = packetData[:int(hdr.Length)-int(hdr.PacketNumberLen)]
+
 	handlePacket(&receivedPacket{
 		remoteAddr: addr,
 		header:     hdr,
 		data:       packetData,
 		rcvTime:    rcvTime,
 	})
+
+	// A UDP datagram may coalesce multiple Initial/Handshake/0-RTT packets (and a
+	// trailing 1-RTT packet); dispatch each one we can still parse, sharing rcvTime and
+	// remoteAddr. A parse error on the remainder is discarded, not fatal, per RFC 9000
+	// section 12.2.
+	for len(rest) > 0 {
+		rr := bytes.NewReader(rest)
+		nextIHdr, err := wire.ParseInvariantHeader(rr, h.connIDLen)
+		if err != nil {
+			break
+		}
+		nextHdr, err := nextIHdr.Parse(rr, sentBy, version)
+		if err != nil {
+			break
+		}
+		nextHdr.Raw = rest[:len(rest)-rr.Len()]
+		nextPacketData := rest[len(rest)-rr.Len():]
+
+		// Re-resolve the handler for this packet's connection ID rather than reusing
+		// handlePacket as captured above: when the datagram's first packet was for a
+		// brand-new connection, handlePacket is server.handlePacket, and handling that
+		// first packet may have just registered a session in h.handlers that this
+		// packet should now be delivered to.
+		nextHandlePacket := h.resolveHandlePacket(nextIHdr.DestConnectionID, handlePacket)
+
+		if !nextHdr.IsLongHeader {
+			// Short-header packets run to the end of the datagram, so this is the last
+			// packet in the coalesced set.
+			nextHandlePacket(&receivedPacket{
+				remoteAddr: addr,
+				header:     nextHdr,
+				data:       nextPacketData,
+				rcvTime:    rcvTime,
+			})
+			break
+		}
+		if nextHdr.Length < protocol.ByteCount(nextHdr.PacketNumberLen) {
+			break
+		}
+		if protocol.ByteCount(len(nextPacketData))+protocol.ByteCount(nextHdr.PacketNumberLen) < nextHdr.Length {
+			break
+		}
+		consumed := int(nextHdr.Length) - int(nextHdr.PacketNumberLen)
+		thisPacketData := nextPacketData[:consumed]
+		rest = nextPacketData[consumed:]
+
+		nextHandlePacket(&receivedPacket{
+			remoteAddr: addr,
+			header:     nextHdr,
+			data:       thisPacketData,
+			rcvTime:    rcvTime,
+		})
+	}
 	return nil
 }
@@ -1,14 +1,28 @@
 package fdns
 
 import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
 	"net/url"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	quic "github.com/lucas-clemente/quic-go"
 	"github.com/miekg/dns"
 )
 
@@ -38,14 +52,36 @@ func randAsciiString(n int) string {
 var ErrDNSEmpty = errors.New("No DNS record found")
 var ErrDNSTimeout = errors.New("DNS timeout")
 
+// Upstream hides the wire transport (plain UDP/TCP, DoT, DoH or DoQ) used to reach a
+// resolver, so lookup only has to call Exchange.
+type Upstream interface {
+	Exchange(m *dns.Msg) (*dns.Msg, error)
+}
+
 type ServerConfig struct {
 	Server      string
 	Timeout     int
 	MaxResponse int
 
+	// TLSServerName overrides the TLS ServerName used to dial tls://, https:// and quic://
+	// upstreams; it defaults to the host portion of Server.
+	TLSServerName string
+	// PinnedSPKI, when set, is the base64 standard encoded sha256 of the upstream
+	// certificate's SubjectPublicKeyInfo; the TLS handshake fails unless it matches.
+	PinnedSPKI string
+	// Bootstrap is a plain ServerConfig (usually udp://) used to resolve the hostname in
+	// Server before dialing tls://, https:// or quic:// upstreams that aren't a literal IP.
+	Bootstrap *ServerConfig
+	// ECS overrides Config.ClientSubnetPolicy for this upstream; nil means "use the
+	// Config-level policy".
+	ECS *ClientSubnetPolicy
+
 	network string
 	addr    string
 	timeout time.Duration
+
+	upstreamOnce sync.Once
+	upstreamImpl Upstream
 }
 
 func (c *ServerConfig) init() {
@@ -61,7 +97,14 @@ func (c *ServerConfig) init() {
 		c.addr = u.Host
 	}
 	if !strings.Contains(c.addr, ":") {
-		c.addr = c.addr + ":53"
+		switch c.network {
+		case "https":
+			c.addr = c.addr + ":443"
+		case "tls", "quic":
+			c.addr = c.addr + ":853"
+		default:
+			c.addr = c.addr + ":53"
+		}
 	}
 	if c.Timeout == 0 {
 		c.Timeout = 800
@@ -69,6 +112,393 @@ func (c *ServerConfig) init() {
 	c.timeout = time.Duration(c.Timeout) * time.Millisecond
 }
 
+// upstream lazily builds the encrypted transport for this server, returning nil for the
+// plain udp/tcp networks which lookup already knows how to dial directly.
+func (c *ServerConfig) upstream() Upstream {
+	c.upstreamOnce.Do(func() {
+		switch c.network {
+		case "tls":
+			c.upstreamImpl = newDoTUpstream(c)
+		case "https":
+			c.upstreamImpl = newDoHUpstream(c)
+		case "quic":
+			c.upstreamImpl = newDoQUpstream(c)
+		}
+	})
+	return c.upstreamImpl
+}
+
+// bootstrapResolve resolves host using a plain ServerConfig, for DoT/DoH/DoQ upstreams
+// whose Server names a host rather than a literal IP.
+func bootstrapResolve(b *ServerConfig, host string) (net.IP, error) {
+	if ip := net.ParseIP(host); nil != ip {
+		return ip, nil
+	}
+	if nil == b {
+		return nil, fmt.Errorf("fdns: %s is not an IP and no Bootstrap resolver is configured", host)
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(host), dns.TypeA)
+	c, err := net.DialTimeout(b.network, b.addr, b.timeout)
+	if nil != err {
+		return nil, err
+	}
+	defer c.Close()
+	dnsConn := &dns.Conn{Conn: c}
+	dnsConn.SetWriteDeadline(time.Now().Add(b.timeout))
+	if err = dnsConn.WriteMsg(m); nil != err {
+		return nil, err
+	}
+	dnsConn.SetReadDeadline(time.Now().Add(b.timeout))
+	res, err := dnsConn.ReadMsg()
+	if nil != err {
+		return nil, err
+	}
+	for _, rr := range res.Answer {
+		if a, ok := rr.(*dns.A); ok {
+			return a.A, nil
+		}
+	}
+	return nil, ErrDNSEmpty
+}
+
+// resolvedAddr applies Bootstrap (if any) to turn cfg.addr into a dial-able host:port.
+func resolvedAddr(cfg *ServerConfig) (string, error) {
+	host, port, err := net.SplitHostPort(cfg.addr)
+	if nil != err {
+		return "", err
+	}
+	ip, err := bootstrapResolve(cfg.Bootstrap, host)
+	if nil != err {
+		return "", err
+	}
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+func tlsConfigFor(c *ServerConfig) *tls.Config {
+	serverName := c.TLSServerName
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(c.addr)
+	}
+	conf := &tls.Config{ServerName: serverName}
+	if c.PinnedSPKI != "" {
+		pin := c.PinnedSPKI
+		conf.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			for _, raw := range rawCerts {
+				cert, err := x509.ParseCertificate(raw)
+				if nil != err {
+					continue
+				}
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if base64.StdEncoding.EncodeToString(sum[:]) == pin {
+					return nil
+				}
+			}
+			return fmt.Errorf("fdns: no certificate matched pinned SPKI for %s", c.addr)
+		}
+	}
+	return conf
+}
+
+// dotUpstream implements DNS-over-TLS (RFC 7858) over a single kept-alive connection,
+// redialing on the next Exchange after any read/write error.
+type dotUpstream struct {
+	cfg *ServerConfig
+
+	mu   sync.Mutex
+	conn *dns.Conn
+
+	// ioMu serializes Exchange's write+read pair on the shared connection so
+	// concurrent trusted queries can't interleave WriteMsg/ReadMsg and hand one
+	// caller another caller's answer (or corrupt the TCP message framing).
+	ioMu sync.Mutex
+}
+
+func newDoTUpstream(cfg *ServerConfig) *dotUpstream {
+	return &dotUpstream{cfg: cfg}
+}
+
+func (u *dotUpstream) dial() (*dns.Conn, error) {
+	addr, err := resolvedAddr(u.cfg)
+	if nil != err {
+		return nil, err
+	}
+	tlsConn, err := tls.DialWithDialer(&net.Dialer{Timeout: u.cfg.timeout}, "tcp", addr, tlsConfigFor(u.cfg))
+	if nil != err {
+		return nil, err
+	}
+	return &dns.Conn{Conn: tlsConn}, nil
+}
+
+func (u *dotUpstream) getConn() (*dns.Conn, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if nil != u.conn {
+		return u.conn, nil
+	}
+	conn, err := u.dial()
+	if nil != err {
+		return nil, err
+	}
+	u.conn = conn
+	return conn, nil
+}
+
+func (u *dotUpstream) invalidate(conn *dns.Conn) {
+	u.mu.Lock()
+	if u.conn == conn {
+		conn.Close()
+		u.conn = nil
+	}
+	u.mu.Unlock()
+}
+
+func (u *dotUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	conn, err := u.getConn()
+	if nil != err {
+		return nil, err
+	}
+	u.ioMu.Lock()
+	defer u.ioMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(u.cfg.timeout))
+	if err = conn.WriteMsg(m); nil != err {
+		u.invalidate(conn)
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(u.cfg.timeout))
+	res, err := conn.ReadMsg()
+	if nil != err {
+		u.invalidate(conn)
+		return nil, err
+	}
+	return res, nil
+}
+
+// dohUpstream implements DNS-over-HTTPS (RFC 8484) POST mode on top of an http.Client
+// whose Transport pools connections and prefers HTTP/2.
+type dohUpstream struct {
+	cfg    *ServerConfig
+	client *http.Client
+	url    string
+}
+
+func newDoHUpstream(cfg *ServerConfig) *dohUpstream {
+	transport := &http.Transport{
+		TLSClientConfig:     tlsConfigFor(cfg),
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        8,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	if nil != cfg.Bootstrap {
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if nil != err {
+				return nil, err
+			}
+			ip, err := bootstrapResolve(cfg.Bootstrap, host)
+			if nil != err {
+				return nil, err
+			}
+			d := net.Dialer{Timeout: cfg.timeout}
+			return d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return &dohUpstream{
+		cfg:    cfg,
+		client: &http.Client{Transport: transport, Timeout: cfg.timeout},
+		url:    "https://" + cfg.addr + "/dns-query",
+	}
+}
+
+func (u *dohUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	req, err := m.Pack()
+	if nil != err {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest("POST", u.url, bytes.NewReader(req))
+	if nil != err {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/dns-message")
+	httpReq.Header.Set("Accept", "application/dns-message")
+	httpResp, err := u.client.Do(httpReq)
+	if nil != err {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fdns: doh upstream %s returned status %d", u.url, httpResp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if nil != err {
+		return nil, err
+	}
+	res := new(dns.Msg)
+	if err = res.Unpack(body); nil != err {
+		return nil, err
+	}
+	return res, nil
+}
+
+// doqUpstream implements the experimental DNS-over-QUIC transport: one bidirectional
+// stream per query on a shared, lazily-redialed session, each message length-prefixed
+// per the current doq draft.
+type doqUpstream struct {
+	cfg *ServerConfig
+
+	mu      sync.Mutex
+	session quic.Session
+}
+
+func newDoQUpstream(cfg *ServerConfig) *doqUpstream {
+	return &doqUpstream{cfg: cfg}
+}
+
+func (u *doqUpstream) getSession() (quic.Session, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if nil != u.session {
+		return u.session, nil
+	}
+	addr, err := resolvedAddr(u.cfg)
+	if nil != err {
+		return nil, err
+	}
+	tlsConf := tlsConfigFor(u.cfg)
+	tlsConf.NextProtos = []string{"doq"}
+	ctx, cancel := context.WithTimeout(context.Background(), u.cfg.timeout)
+	defer cancel()
+	sess, err := quic.DialAddrContext(ctx, addr, tlsConf, nil)
+	if nil != err {
+		return nil, err
+	}
+	u.session = sess
+	return sess, nil
+}
+
+func (u *doqUpstream) invalidate(sess quic.Session) {
+	u.mu.Lock()
+	if u.session == sess {
+		sess.CloseWithError(0, "")
+		u.session = nil
+	}
+	u.mu.Unlock()
+}
+
+func (u *doqUpstream) Exchange(m *dns.Msg) (*dns.Msg, error) {
+	sess, err := u.getSession()
+	if nil != err {
+		return nil, err
+	}
+	stream, err := sess.OpenStreamSync(context.Background())
+	if nil != err {
+		u.invalidate(sess)
+		return nil, err
+	}
+	defer stream.Close()
+	req, err := m.Pack()
+	if nil != err {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint16(len(req)))
+	buf.Write(req)
+	stream.SetDeadline(time.Now().Add(u.cfg.timeout))
+	if _, err = stream.Write(buf.Bytes()); nil != err {
+		u.invalidate(sess)
+		return nil, err
+	}
+	var lenBuf [2]byte
+	if _, err = io.ReadFull(stream, lenBuf[:]); nil != err {
+		u.invalidate(sess)
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+	if _, err = io.ReadFull(stream, resp); nil != err {
+		u.invalidate(sess)
+		return nil, err
+	}
+	res := new(dns.Msg)
+	if err = res.Unpack(resp); nil != err {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ClientSubnetPolicy controls whether lookup attaches an EDNS0-Client-Subnet option
+// (RFC 7871) to outgoing queries.
+type ClientSubnetPolicy int
+
+const (
+	// ECSOff never attaches ECS.
+	ECSOff ClientSubnetPolicy = iota
+	// ECSAlways attaches ECS on every trusted and fast lookup.
+	ECSAlways
+	// ECSFastOnly attaches ECS only on fast (non-trusted) lookups, where CDN-directed
+	// answers matter and there's no pollution-detection probe to disturb.
+	ECSFastOnly
+)
+
+// ecsContext carries the subnet to advertise and the policy deciding when to advertise
+// it through a single lookup call.
+type ecsContext struct {
+	subnet *net.IPNet
+	policy ClientSubnetPolicy
+}
+
+func attachECS(ecs ecsContext, trusted bool) bool {
+	if nil == ecs.subnet {
+		return false
+	}
+	switch ecs.policy {
+	case ECSAlways:
+		return true
+	case ECSFastOnly:
+		return !trusted
+	default:
+		return false
+	}
+}
+
+func ecsOption(subnet *net.IPNet) *dns.EDNS0_SUBNET {
+	e := new(dns.EDNS0_SUBNET)
+	e.Code = dns.EDNS0SUBNET
+	ones, _ := subnet.Mask.Size()
+	if ip4 := subnet.IP.To4(); nil != ip4 {
+		e.Family = 1
+		e.Address = ip4
+	} else {
+		e.Family = 2
+		e.Address = subnet.IP
+	}
+	e.SourceNetmask = uint8(ones)
+	e.SourceScope = 0
+	return e
+}
+
+// clientSubnetFromAddr derives the ECS subnet to advertise for an inbound query: a /24
+// for IPv4 requesters, a /56 for IPv6, per the RFC 7871 privacy-conscious defaults.
+func clientSubnetFromAddr(addr net.Addr) *net.IPNet {
+	if nil == addr {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if nil != err {
+		host = addr.String()
+	}
+	ip := net.ParseIP(host)
+	if nil == ip {
+		return nil
+	}
+	if ip4 := ip.To4(); nil != ip4 {
+		mask := net.CIDRMask(24, 32)
+		return &net.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := net.CIDRMask(56, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
 type Config struct {
 	Listen     string
 	FastDNS    []ServerConfig
@@ -78,11 +508,47 @@ type Config struct {
 	IsDomainPoisioned func(string) int
 	DialTimeout       func(network, addr string, timeout time.Duration) (net.Conn, error)
 	IsCNIP            func(ip net.IP) bool
+
+	// ClientSubnet is the EDNS0-Client-Subnet to advertise when ClientSubnetPolicy calls
+	// for it; leave nil to instead derive one per-request from the querying client's
+	// address (see QueryFrom).
+	ClientSubnet       *net.IPNet
+	ClientSubnetPolicy ClientSubnetPolicy
+
+	// TrustAnchors are the trusted DNSKEYs (e.g. the IANA root KSK) that DNSSEC
+	// validation walks down from towards the queried zone.
+	TrustAnchors []dns.DNSKEY
+	// DNSSECMode controls whether trusted-branch answers are validated against
+	// TrustAnchors before being handed back.
+	DNSSECMode DNSSECMode
+
+	// CacheSize bounds the number of (qname, qtype, branch, ecs-prefix) entries kept in
+	// the in-memory answer cache; 0 disables caching entirely.
+	CacheSize int
+	// MaxNegativeTTL caps how long an NXDOMAIN/NODATA result is cached, regardless of the
+	// SOA MINIMUM the authority advertised; 0 means "no cap".
+	MaxNegativeTTL uint32
 }
 
+// DNSSECMode controls how strictly TrustedDNS validates trusted-branch answers.
+type DNSSECMode int
+
+const (
+	// DNSSECOff performs no validation.
+	DNSSECOff DNSSECMode = iota
+	// DNSSECPermissive validates signed zones but lets unsigned zones and validation
+	// failures that can't be chained through an expected trust anchor pass through.
+	DNSSECPermissive
+	// DNSSECStrict refuses to return any trusted-branch answer whose RRSIG/NSEC chain
+	// doesn't validate, downgrading it to a SERVFAIL-style error instead.
+	DNSSECStrict
+)
+
 type TrustedDNS struct {
 	DomainMarkSet sync.Map
 	Config        Config
+
+	cache *dnsCache
 }
 
 func selectIP(ips []net.IP) net.IP {
@@ -106,28 +572,87 @@ func selectDNSServer(ss []ServerConfig) *ServerConfig {
 	return server
 }
 
-func (t *TrustedDNS) lookup(domain string, trusted bool, rtype uint16) ([]dns.RR, bool, error) {
+// selectPlainDNSServer is like selectDNSServer but only considers udp/tcp ServerConfigs,
+// for callers (zone transfers) that speak plain DNS wire framing and can't ride a DoT/DoH/
+// DoQ upstream. It returns nil if ss has no plain udp/tcp entry.
+func selectPlainDNSServer(ss []ServerConfig) *ServerConfig {
+	var plain []*ServerConfig
+	for i := range ss {
+		switch ss[i].network {
+		case "udp", "tcp":
+			plain = append(plain, &ss[i])
+		}
+	}
+	if len(plain) == 0 {
+		return nil
+	}
+	if len(plain) == 1 {
+		return plain[0]
+	}
+	return plain[rand.Intn(len(plain))]
+}
+
+// lookupMsg performs the wire exchange and returns the full response message, so callers
+// that need more than the answer section (DNSSEC validation needs Rcode/Ns) can inspect it.
+func (t *TrustedDNS) lookupMsg(domain string, trusted bool, rtype uint16, ecs ecsContext) (*dns.Msg, bool, error) {
 	var server *ServerConfig
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(domain), rtype)
 	waitCount := 1
 	polluted := false
+	var opt *dns.OPT
 	if trusted {
 		server = selectDNSServer(t.Config.TrustedDNS)
 		m.Compress = true
-		o := new(dns.OPT)
-		o.Hdr.Name = "."
-		o.Hdr.Rrtype = dns.TypeOPT
+		opt = new(dns.OPT)
+		opt.Hdr.Name = "."
+		opt.Hdr.Rrtype = dns.TypeOPT
 		e := new(dns.EDNS0_NSID)
 		e.Code = dns.EDNS0NSID
 		e.Nsid = "AA"
-		o.Option = append(o.Option, e)
-		m.Extra = append(m.Extra, o)
+		opt.Option = append(opt.Option, e)
+		m.Extra = append(m.Extra, opt)
 		//m.SetEdns0(128, false)
 		waitCount = server.MaxResponse
 	} else {
 		server = selectDNSServer(t.Config.FastDNS)
 	}
+
+	if nil != server.ECS {
+		ecs.policy = *server.ECS
+	}
+	if attachECS(ecs, trusted) {
+		if nil == opt {
+			opt = new(dns.OPT)
+			opt.Hdr.Name = "."
+			opt.Hdr.Rrtype = dns.TypeOPT
+			m.Extra = append(m.Extra, opt)
+		}
+		opt.Option = append(opt.Option, ecsOption(ecs.subnet))
+	}
+
+	if trusted && t.Config.DNSSECMode != DNSSECOff {
+		if nil == opt {
+			opt = new(dns.OPT)
+			opt.Hdr.Name = "."
+			opt.Hdr.Rrtype = dns.TypeOPT
+			m.Extra = append(m.Extra, opt)
+		}
+		opt.SetDo()
+		opt.SetUDPSize(4096)
+		m.CheckingDisabled = false
+	}
+
+	// Encrypted upstreams (DoT/DoH/DoQ) don't need the multi-response pollution probe
+	// below since the channel itself can't be tampered with in transit.
+	if up := server.upstream(); nil != up {
+		res, err := up.Exchange(m)
+		if nil != err {
+			return nil, false, err
+		}
+		return res, false, nil
+	}
+
 	timeout := time.Now().Add(server.timeout)
 	dnsConn := new(dns.Conn)
 	var c net.Conn
@@ -144,7 +669,6 @@ func (t *TrustedDNS) lookup(domain string, trusted bool, rtype uint16) ([]dns.RR
 	dnsConn.WriteMsg(m)
 	dnsConn.SetReadDeadline(timeout)
 	defer dnsConn.Close()
-	var rrs []dns.RR
 	for i := 0; i < waitCount; i++ {
 		res, err := dnsConn.ReadMsg()
 		//log.Printf("###%s %d %v", server.addr, i, res)
@@ -153,21 +677,630 @@ func (t *TrustedDNS) lookup(domain string, trusted bool, rtype uint16) ([]dns.RR
 			if trusted && nil == res.IsEdns0() {
 				continue
 			}
-			rrs = res.Answer
+			if res.Truncated && server.network != "tcp" {
+				if tcpRes, tcpErr := t.lookupTCPFallback(server, m); nil == tcpErr {
+					res = tcpRes
+				}
+			}
 			if i > 0 {
 				polluted = true
 			}
-			return rrs, polluted, nil
+			return res, polluted, nil
+		}
+		if err == dns.ErrTruncated && server.network != "tcp" {
+			if tcpRes, tcpErr := t.lookupTCPFallback(server, m); nil == tcpErr {
+				return tcpRes, polluted, nil
+			}
 		}
 		break
 	}
+	return nil, polluted, ErrDNSEmpty
+}
+
+// lookupTCPFallback reissues m over TCP against server with a 4096-byte buffer, used
+// when the UDP answer came back truncated (large TXT/DNSKEY answers, most often).
+func (t *TrustedDNS) lookupTCPFallback(server *ServerConfig, m *dns.Msg) (*dns.Msg, error) {
+	var c net.Conn
+	var err error
+	if nil != t.Config.DialTimeout {
+		c, err = t.Config.DialTimeout("tcp", server.addr, server.timeout)
+	} else {
+		c, err = net.DialTimeout("tcp", server.addr, server.timeout)
+	}
+	if nil != err {
+		return nil, err
+	}
+	defer c.Close()
+	dnsConn := &dns.Conn{Conn: c, UDPSize: 4096}
+	dnsConn.SetWriteDeadline(time.Now().Add(server.timeout))
+	if err = dnsConn.WriteMsg(m); nil != err {
+		return nil, err
+	}
+	dnsConn.SetReadDeadline(time.Now().Add(server.timeout))
+	return dnsConn.ReadMsg()
+}
+
+// soaMinTTL extracts the SOA MINIMUM from an authority section, used as the negative
+// caching TTL for NXDOMAIN/NODATA per RFC 2308.
+func soaMinTTL(res *dns.Msg) (uint32, bool) {
+	for _, rr := range res.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Minttl, true
+		}
+	}
+	return 0, false
+}
+
+func (t *TrustedDNS) lookup(domain string, trusted bool, rtype uint16, ecs ecsContext) (rrs []dns.RR, polluted bool, negTTL uint32, err error) {
+	res, polluted, err := t.lookupMsg(domain, trusted, rtype, ecs)
+	if nil != err {
+		return nil, polluted, 0, err
+	}
+	if len(res.Answer) == 0 {
+		negTTL, _ = soaMinTTL(res)
+		return nil, polluted, negTTL, ErrDNSEmpty
+	}
+	return res.Answer, polluted, 0, nil
+}
+
+// lookupTrusted is the trusted-branch counterpart of lookup that additionally validates
+// DNSSEC when Config.DNSSECMode calls for it, refusing to hand back unvalidated data.
+func (t *TrustedDNS) lookupTrusted(domain string, rtype uint16, ecs ecsContext) (ips []dns.RR, authenticated bool, polluted bool, negTTL uint32, err error) {
+	res, polluted, err := t.lookupMsg(domain, true, rtype, ecs)
+	if nil != err {
+		return nil, false, polluted, 0, err
+	}
+	allowed, authenticated, verr := t.validateTrustedAnswer(domain, rtype, res)
+	if !allowed {
+		return nil, false, polluted, 0, fmt.Errorf("fdns: SERVFAIL: %v", verr)
+	}
+	if len(res.Answer) == 0 {
+		negTTL, _ = soaMinTTL(res)
+		return nil, authenticated, polluted, negTTL, ErrDNSEmpty
+	}
+	return res.Answer, authenticated, polluted, 0, nil
+}
+
+// validateTrustedAnswer checks a trusted-branch response against Config.DNSSECMode.
+// allowed reports whether the caller should hand the answer back at all (false means
+// SERVFAIL); authenticated reports whether it was cryptographically proven good, which
+// callers use to decide whether to set AD=1.
+func (t *TrustedDNS) validateTrustedAnswer(domain string, rtype uint16, res *dns.Msg) (allowed bool, authenticated bool, err error) {
+	if t.Config.DNSSECMode == DNSSECOff {
+		return true, false, nil
+	}
+	if len(res.Answer) == 0 {
+		ok, derr := t.denyExistence(domain, rtype, res)
+		if ok {
+			return true, true, nil
+		}
+		if t.Config.DNSSECMode == DNSSECStrict {
+			return false, false, derr
+		}
+		return true, false, nil
+	}
+	data, sigs := splitRRSIG(res.Answer)
+	if len(sigs) == 0 {
+		if t.Config.DNSSECMode == DNSSECStrict {
+			return false, false, fmt.Errorf("no RRSIG covering %s %s", domain, dns.TypeToString[rtype])
+		}
+		return true, false, nil
+	}
+	zone := signerZone(sigs)
+	keys, kerr := t.zoneKeys(zone)
+	if nil != kerr {
+		if t.Config.DNSSECMode == DNSSECStrict {
+			return false, false, kerr
+		}
+		return true, false, nil
+	}
+	if !verifyRRset(data, sigs, keys, time.Now()) {
+		return false, false, fmt.Errorf("RRSIG for %s %s failed to validate", domain, dns.TypeToString[rtype])
+	}
+	return true, true, nil
+}
+
+// zoneKeys returns the validated DNSKEY set for zone, walking DS->DNSKEY down from the
+// nearest configured trust anchor.
+func (t *TrustedDNS) zoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	zone = dns.Fqdn(zone)
+	res, _, err := t.lookupMsg(zone, true, dns.TypeDNSKEY, ecsContext{})
+	if nil != err {
+		return nil, err
+	}
+	keyRRs, sigRRs := splitRRSIG(res.Answer)
+	var keys []*dns.DNSKEY
+	for _, rr := range keyRRs {
+		if k, ok := rr.(*dns.DNSKEY); ok {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no DNSKEY found for %s", zone)
+	}
+
+	if anchors := t.anchorsFor(zone); len(anchors) > 0 {
+		if !verifyRRset(keyRRs, sigRRs, anchors, time.Now()) {
+			return nil, fmt.Errorf("DNSKEY for %s does not validate against trust anchor", zone)
+		}
+		return keys, nil
+	}
+
+	parent := parentZone(zone)
+	if parent == "" {
+		return nil, fmt.Errorf("no trust anchor covers %s", zone)
+	}
+	parentKeys, err := t.zoneKeys(parent)
+	if nil != err {
+		return nil, err
+	}
+
+	dsRes, _, err := t.lookupMsg(zone, true, dns.TypeDS, ecsContext{})
+	if nil != err {
+		return nil, err
+	}
+	dsRRs, dsSigs := splitRRSIG(dsRes.Answer)
+	if !verifyRRset(dsRRs, dsSigs, parentKeys, time.Now()) {
+		return nil, fmt.Errorf("DS for %s does not validate against %s", zone, parent)
+	}
+	var dss []*dns.DS
+	for _, rr := range dsRRs {
+		if ds, ok := rr.(*dns.DS); ok {
+			dss = append(dss, ds)
+		}
+	}
+
+	// The zone's DNSKEY rrset must be self-signed by one of its own keys, and that key
+	// must in turn be vouched for by a DS record the parent just validated above.
+	for _, sig := range sigRRs {
+		if sig.TypeCovered != dns.TypeDNSKEY || !sig.ValidityPeriod(time.Now()) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag {
+				continue
+			}
+			if nil != sig.Verify(k, keyRRs) {
+				continue
+			}
+			if matchDS(k, dss) {
+				return keys, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("DNSKEY for %s does not chain to a DS at %s", zone, parent)
+}
+
+func (t *TrustedDNS) anchorsFor(zone string) []*dns.DNSKEY {
+	var anchors []*dns.DNSKEY
+	for i := range t.Config.TrustAnchors {
+		a := &t.Config.TrustAnchors[i]
+		if strings.EqualFold(a.Hdr.Name, zone) {
+			anchors = append(anchors, a)
+		}
+	}
+	return anchors
+}
+
+func parentZone(zone string) string {
+	zone = dns.Fqdn(zone)
+	if zone == "." {
+		return ""
+	}
+	labels := dns.SplitDomainName(zone)
+	if len(labels) <= 1 {
+		return "."
+	}
+	return dns.Fqdn(strings.Join(labels[1:], "."))
+}
+
+func signerZone(sigs []*dns.RRSIG) string {
+	if len(sigs) == 0 {
+		return ""
+	}
+	return dns.Fqdn(sigs[0].SignerName)
+}
+
+func splitRRSIG(rrs []dns.RR) ([]dns.RR, []*dns.RRSIG) {
+	var data []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			sigs = append(sigs, sig)
+		} else {
+			data = append(data, rr)
+		}
+	}
+	return data, sigs
+}
+
+func verifyRRset(data []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY, now time.Time) bool {
+	if len(data) == 0 {
+		return false
+	}
+	covered := data[0].Header().Rrtype
+	for _, sig := range sigs {
+		if sig.TypeCovered != covered || !sig.ValidityPeriod(now) {
+			continue
+		}
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag {
+				continue
+			}
+			if nil == sig.Verify(key, data) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchDS(key *dns.DNSKEY, dss []*dns.DS) bool {
+	for _, ds := range dss {
+		candidate := key.ToDS(ds.DigestType)
+		if nil != candidate && strings.EqualFold(candidate.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyExistence checks that an NXDOMAIN/NODATA response is provably empty via the
+// NSEC/NSEC3 records in the authority section, per RFC 4035 / RFC 5155.
+func (t *TrustedDNS) denyExistence(qname string, rtype uint16, res *dns.Msg) (bool, error) {
+	qname = dns.Fqdn(qname)
+	var nsec3s []*dns.NSEC3
+	var nsecs []*dns.NSEC
+	var signer string
+	for _, rr := range res.Ns {
+		switch v := rr.(type) {
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, v)
+		case *dns.NSEC:
+			nsecs = append(nsecs, v)
+		case *dns.RRSIG:
+			if v.TypeCovered == dns.TypeNSEC || v.TypeCovered == dns.TypeNSEC3 || v.TypeCovered == dns.TypeSOA {
+				signer = v.SignerName
+			}
+		}
+	}
+	if len(nsec3s) == 0 && len(nsecs) == 0 {
+		return false, fmt.Errorf("no NSEC/NSEC3 records to deny existence of %s", qname)
+	}
+	if signer == "" {
+		return false, fmt.Errorf("no RRSIG signer found for denial records covering %s", qname)
+	}
+	keys, err := t.zoneKeys(signer)
+	if nil != err {
+		return false, err
+	}
+	data, sigs := splitRRSIG(res.Ns)
+	if !verifyRRset(data, sigs, keys, time.Now()) {
+		return false, fmt.Errorf("NSEC/NSEC3 RRSIG covering %s failed to validate", qname)
+	}
+	if len(nsec3s) > 0 {
+		return nsec3Denies(qname, rtype, nsec3s), nil
+	}
+	return nsecDenies(qname, rtype, nsecs), nil
+}
+
+func nsec3Denies(qname string, rtype uint16, recs []*dns.NSEC3) bool {
+	for _, rec := range recs {
+		owner := strings.ToUpper(strings.SplitN(rec.Header().Name, ".", 2)[0])
+		hash := strings.ToUpper(dns.HashName(qname, rec.Hash, rec.Iterations, rec.Salt))
+		if hash == owner {
+			return !nsec3CoversType(rec, rtype)
+		}
+		if nameCovers(owner, strings.ToUpper(rec.NextDomain), hash) {
+			return true
+		}
+	}
+	return false
+}
+
+func nsec3CoversType(rec *dns.NSEC3, rtype uint16) bool {
+	for _, t := range rec.TypeBitMap {
+		if t == rtype {
+			return true
+		}
+	}
+	return false
+}
+
+func nsecDenies(qname string, rtype uint16, recs []*dns.NSEC) bool {
+	qname = strings.ToLower(qname)
+	for _, rec := range recs {
+		owner := strings.ToLower(rec.Header().Name)
+		if qname == owner {
+			for _, t := range rec.TypeBitMap {
+				if t == rtype {
+					return false
+				}
+			}
+			return true
+		}
+		if nameCovers(owner, strings.ToLower(rec.NextDomain), qname) {
+			return true
+		}
+	}
+	return false
+}
+
+// nameCovers reports whether target falls in the (owner, next) gap in canonical
+// ordering, accounting for the wraparound at the last name in the zone.
+func nameCovers(owner, next, target string) bool {
+	if owner < next {
+		return owner < target && target < next
+	}
+	return owner < target || target < next
+}
+
+// resolveDispatch runs the actual wire lookup for an already-classified domain, without
+// touching the cache or DomainMarkSet; it's shared by lookupRecord's cache-miss path and
+// the prefetch worker.
+func (t *TrustedDNS) resolveDispatch(domain string, rtype uint16, dnsType int, ecs ecsContext) (rrs []dns.RR, authenticated bool, polluted bool, negTTL uint32, err error) {
+	if dnsType == UseTrustedDNS {
+		return t.lookupTrusted(domain, rtype, ecs)
+	}
+	rrs, polluted, negTTL, err = t.lookup(domain, false, rtype, ecs)
+	return
+}
+
+// cacheEntry is one (qname, qtype, branch, ecs-prefix) answer kept by dnsCache, either a
+// positive rrset or a negative (NXDOMAIN/NODATA) marker.
+type cacheEntry struct {
+	elem *list.Element
+
+	domain  string
+	rtype   uint16
+	dnsType int
+	ecs     ecsContext
+
+	rrs           []dns.RR
+	negative      bool
+	authenticated bool
+
+	storedAt  time.Time
+	ttl       uint32
+	lastQuery time.Time
+}
+
+func (e *cacheEntry) remaining(now time.Time) int64 {
+	return int64(e.ttl) - int64(now.Sub(e.storedAt).Seconds())
+}
+
+// copyRRs deep-copies rrs so a cacheEntry never aliases RRs owned by whichever caller
+// resolved them, and a caller reading an entry back out never aliases the cache's copy.
+func copyRRs(rrs []dns.RR) []dns.RR {
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = rr.Copy()
+	}
+	return out
+}
+
+// copyRRsDecrementTTL is copyRRs plus subtracting elapsed (seconds of cache residency)
+// from each record's TTL, floored at 0, so a cache hit hands back a remaining-TTL-aware
+// answer instead of perpetually replaying the TTL captured at store time.
+func copyRRsDecrementTTL(rrs []dns.RR, elapsed int64) []dns.RR {
+	out := make([]dns.RR, len(rrs))
+	for i, rr := range rrs {
+		c := rr.Copy()
+		ttl := int64(c.Header().Ttl) - elapsed
+		if ttl < 0 {
+			ttl = 0
+		}
+		c.Header().Ttl = uint32(ttl)
+		out[i] = c
+	}
+	return out
+}
+
+// dnsCache is a size-bounded LRU keyed by (qname, qtype, branch, ecs-prefix), storing the
+// min TTL observed at store time so callers can decrement on serve.
+type dnsCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*cacheEntry
+	lru     *list.List
+
+	hits, misses int64
+}
+
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{size: size, entries: make(map[string]*cacheEntry), lru: list.New()}
+}
+
+// cacheKey partitions the cache by ECS subnet only when the Config-level policy in ecs
+// would attach that subnet to the wire query for this branch (see attachECS): with the
+// common ECSOff policy, QueryFrom still derives a subnet per requester, but none is sent,
+// and the cache must not fragment into one partition per client IP for an answer that's
+// identical for everyone. A per-upstream ServerConfig.ECS override is not reflected in
+// the key.
+func cacheKey(domain string, rtype uint16, dnsType int, ecs ecsContext) string {
+	prefix := ""
+	if attachECS(ecs, dnsType == UseTrustedDNS) {
+		prefix = ecs.subnet.String()
+	}
+	return fmt.Sprintf("%s|%d|%d|%s", dns.Fqdn(domain), rtype, dnsType, prefix)
+}
+
+func (c *dnsCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && e.remaining(time.Now()) <= 0 {
+		c.removeLocked(key)
+		ok = false
+	}
+	if ok {
+		e.lastQuery = time.Now()
+		c.lru.MoveToFront(e.elem)
+	}
+	c.mu.Unlock()
+	if ok {
+		atomic.AddInt64(&c.hits, 1)
+		return e, true
+	}
+	atomic.AddInt64(&c.misses, 1)
+	return nil, false
+}
+
+func (c *dnsCache) put(key string, e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// A prefetch refresh replaces a live entry: keep its last client query time so that
+	// storing the refreshed answer does not itself count as a recent query.
+	if old, ok := c.entries[key]; ok {
+		e.lastQuery = old.lastQuery
+	} else {
+		e.lastQuery = time.Now()
+	}
+	c.removeLocked(key)
+	e.elem = c.lru.PushFront(key)
+	c.entries[key] = e
+	for c.size > 0 && len(c.entries) > c.size {
+		back := c.lru.Back()
+		if nil == back {
+			break
+		}
+		c.removeLocked(back.Value.(string))
+	}
+}
+
+func (c *dnsCache) removeLocked(key string) {
+	if e, ok := c.entries[key]; ok {
+		c.lru.Remove(e.elem)
+		delete(c.entries, key)
+	}
+}
+
+func (c *dnsCache) purge(domain string) {
+	domain = dns.Fqdn(domain)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, e := range c.entries {
+		if e.domain == domain {
+			c.removeLocked(key)
+		}
+	}
+}
+
+// dueForPrefetch returns entries whose remaining TTL has dropped below 10% of their
+// stored TTL (floor 5s) and that have been queried within the last 5 minutes, so a
+// prefetch only refreshes answers clients actually still care about.
+func (c *dnsCache) dueForPrefetch(now time.Time) []*cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var due []*cacheEntry
+	for _, e := range c.entries {
+		if e.negative {
+			continue
+		}
+		threshold := int64(e.ttl) / 10
+		if threshold < 5 {
+			threshold = 5
+		}
+		remaining := e.remaining(now)
+		if remaining > 0 && remaining <= threshold && now.Sub(e.lastQuery) < 5*time.Minute {
+			due = append(due, e)
+		}
+	}
+	return due
+}
+
+func (c *dnsCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{
+		Size:   len(c.entries),
+		Hits:   atomic.LoadInt64(&c.hits),
+		Misses: atomic.LoadInt64(&c.misses),
+	}
+}
+
+// CacheStats summarizes TrustedDNS's answer cache for the surrounding proxy to report.
+type CacheStats struct {
+	Size   int
+	Hits   int64
+	Misses int64
+}
+
+func (t *TrustedDNS) cacheGet(domain string, rtype uint16, dnsType int, ecs ecsContext) (*cacheEntry, bool) {
+	if nil == t.cache {
+		return nil, false
+	}
+	return t.cache.get(cacheKey(domain, rtype, dnsType, ecs))
+}
+
+func (t *TrustedDNS) cachePut(domain string, rtype uint16, dnsType int, ecs ecsContext, rrs []dns.RR, authenticated bool, negTTL uint32, err error) {
+	if nil == t.cache {
+		return
+	}
+	if nil != err {
+		if err != ErrDNSEmpty || negTTL == 0 {
+			return
+		}
+		ttl := negTTL
+		if t.Config.MaxNegativeTTL > 0 && ttl > t.Config.MaxNegativeTTL {
+			ttl = t.Config.MaxNegativeTTL
+		}
+		t.cache.put(cacheKey(domain, rtype, dnsType, ecs), &cacheEntry{
+			domain: dns.Fqdn(domain), rtype: rtype, dnsType: dnsType, ecs: ecs,
+			negative: true, ttl: ttl, storedAt: time.Now(),
+		})
+		return
+	}
 	if len(rrs) == 0 {
-		err = ErrDNSEmpty
+		return
+	}
+	minTTL := rrs[0].Header().Ttl
+	for _, rr := range rrs[1:] {
+		if rr.Header().Ttl < minTTL {
+			minTTL = rr.Header().Ttl
+		}
+	}
+	t.cache.put(cacheKey(domain, rtype, dnsType, ecs), &cacheEntry{
+		domain: dns.Fqdn(domain), rtype: rtype, dnsType: dnsType, ecs: ecs,
+		rrs: copyRRs(rrs), authenticated: authenticated, ttl: minTTL, storedAt: time.Now(),
+	})
+}
+
+// Purge evicts every cached entry for domain, across all qtypes, branches and ECS
+// prefixes, for forced invalidation on config reload.
+func (t *TrustedDNS) Purge(domain string) {
+	if nil == t.cache {
+		return
 	}
-	return rrs, polluted, err
+	t.cache.purge(domain)
+}
+
+// Stats reports cache occupancy and hit/miss counters so the surrounding proxy can wire
+// up observability.
+func (t *TrustedDNS) Stats() CacheStats {
+	if nil == t.cache {
+		return CacheStats{}
+	}
+	return t.cache.stats()
+}
+
+func (t *TrustedDNS) startPrefetch() {
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, e := range t.cache.dueForPrefetch(time.Now()) {
+				rrs, authenticated, _, negTTL, err := t.resolveDispatch(e.domain, e.rtype, e.dnsType, e.ecs)
+				t.cachePut(e.domain, e.rtype, e.dnsType, e.ecs, rrs, authenticated, negTTL, err)
+			}
+		}
+	}()
 }
 
-func (t *TrustedDNS) lookupRecord(domain string, rtype uint16) (ips []dns.RR, err error) {
+// lookupRecord resolves domain, routing it through FastDNS or TrustedDNS (classifying it
+// first if this is its first contact) and serving from cache where possible. clientDO
+// reports whether the original client set the EDNS0 DO bit; RRSIGs are stripped from the
+// trusted branch's answer unless it did, since nothing downstream filters them otherwise.
+func (t *TrustedDNS) lookupRecord(domain string, rtype uint16, ecs ecsContext, clientDO bool) (ips []dns.RR, authenticated bool, err error) {
 	isPoisioned := Unknown
 	if strings.HasSuffix(domain, ".cn") {
 		isPoisioned = NotPoisioned
@@ -187,20 +1320,36 @@ func (t *TrustedDNS) lookupRecord(domain string, rtype uint16) (ips []dns.RR, er
 	}
 
 	switch dnsType {
-	case UseTrustedDNS:
-		ips, _, err = t.lookup(domain, true, rtype)
-	case UseFastDNS:
-		ips, _, err = t.lookup(domain, false, rtype)
+	case UseTrustedDNS, UseFastDNS:
+		if cached, ok := t.cacheGet(domain, rtype, dnsType, ecs); ok {
+			authenticated = cached.authenticated
+			if cached.negative {
+				err = ErrDNSEmpty
+			} else {
+				elapsed := int64(time.Since(cached.storedAt).Seconds())
+				ips = copyRRsDecrementTTL(cached.rrs, elapsed)
+			}
+		} else {
+			var negTTL uint32
+			ips, authenticated, _, negTTL, err = t.resolveDispatch(domain, rtype, dnsType, ecs)
+			t.cachePut(domain, rtype, dnsType, ecs, ips, authenticated, negTTL, err)
+		}
 	case Unknown:
+		// The first-contact race between FastDNS and TrustedDNS classifies the domain,
+		// but its trusted-branch side is also this domain's very first (uncached)
+		// answer, so it must go through lookupTrusted just like the cached path above —
+		// otherwise DNSSECStrict never gets a chance to catch a poisoned answer for any
+		// domain that's only ever queried once.
 		var fastResult, trustedResult []dns.RR
 		var fastErr, trustedErr error
+		var trustedAuthenticated bool
 		polluted := false
 		waitCh := make(chan int, 1)
 		go func() {
-			fastResult, _, fastErr = t.lookup(domain, false, rtype)
+			fastResult, _, _, fastErr = t.lookup(domain, false, rtype, ecs)
 			waitCh <- 1
 		}()
-		trustedResult, polluted, trustedErr = t.lookup(domain, true, rtype)
+		trustedResult, trustedAuthenticated, polluted, _, trustedErr = t.lookupTrusted(domain, rtype, ecs)
 		if polluted {
 			dnsType = UseTrustedDNS
 		} else {
@@ -222,7 +1371,7 @@ func (t *TrustedDNS) lookupRecord(domain string, rtype uint16) (ips []dns.RR, er
 		}
 		if dnsType == UseTrustedDNS {
 			t.DomainMarkSet.Store(domain, UseTrustedDNS)
-			ips, err = trustedResult, trustedErr
+			ips, authenticated, err = trustedResult, trustedAuthenticated, trustedErr
 		} else {
 			t.DomainMarkSet.Store(domain, UseFastDNS)
 			ips, err = fastResult, fastErr
@@ -235,32 +1384,67 @@ func (t *TrustedDNS) lookupRecord(domain string, rtype uint16) (ips []dns.RR, er
 			}
 		}
 	}
+	if !clientDO {
+		ips, _ = splitRRSIG(ips)
+	}
 	return
 }
 
+func (t *TrustedDNS) defaultECS() ecsContext {
+	return ecsContext{subnet: t.Config.ClientSubnet, policy: t.Config.ClientSubnetPolicy}
+}
+
 func (t *TrustedDNS) LookupA(domain string) ([]dns.RR, error) {
-	return t.lookupRecord(domain, dns.TypeA)
+	ips, _, err := t.lookupRecord(domain, dns.TypeA, t.defaultECS(), false)
+	return ips, err
 }
 func (t *TrustedDNS) LookupAAAA(domain string) ([]dns.RR, error) {
-	return t.lookupRecord(domain, dns.TypeAAAA)
+	ips, _, err := t.lookupRecord(domain, dns.TypeAAAA, t.defaultECS(), false)
+	return ips, err
 }
 
-func (t *TrustedDNS) Query(r *dns.Msg) (*dns.Msg, error) {
+func (t *TrustedDNS) queryWithECS(r *dns.Msg, ecs ecsContext) (*dns.Msg, error) {
 	res := &dns.Msg{}
 	res.SetReply(r)
+	authenticated := len(r.Question) > 0
+	clientDO := false
+	if opt := r.IsEdns0(); nil != opt {
+		clientDO = opt.Do()
+	}
 	for _, question := range r.Question {
 		domain := question.Name
 		domain = domain[0 : len(domain)-1]
-		if strings.Contains(domain, ".") {
-			rrs, err := t.lookupRecord(domain, question.Qtype)
-			if nil == err {
-				res.Answer = append(res.Answer, rrs...)
-			}
+		if !strings.Contains(domain, ".") {
+			authenticated = false
+			continue
 		}
+		rrs, rrAuthenticated, err := t.lookupRecord(domain, question.Qtype, ecs, clientDO)
+		if nil == err {
+			res.Answer = append(res.Answer, rrs...)
+		}
+		authenticated = authenticated && rrAuthenticated
+	}
+	if authenticated {
+		res.AuthenticatedData = true
 	}
 	return res, nil
 }
 
+func (t *TrustedDNS) Query(r *dns.Msg) (*dns.Msg, error) {
+	return t.queryWithECS(r, t.defaultECS())
+}
+
+// QueryFrom is like Query but, when Config.ClientSubnet is unset, derives the ECS
+// subnet to advertise from the requester's address so ServeDNS can hand FastDNS
+// CDN-aware hints without operators having to configure a static subnet.
+func (t *TrustedDNS) QueryFrom(r *dns.Msg, client net.Addr) (*dns.Msg, error) {
+	ecs := t.defaultECS()
+	if nil == ecs.subnet {
+		ecs.subnet = clientSubnetFromAddr(client)
+	}
+	return t.queryWithECS(r, ecs)
+}
+
 func (t *TrustedDNS) QueryRaw(p []byte) ([]byte, error) {
 	req := &dns.Msg{}
 	err := req.Unpack(p)
@@ -276,7 +1460,16 @@ func (t *TrustedDNS) QueryRaw(p []byte) ([]byte, error) {
 }
 
 func (t *TrustedDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
-	res, err := t.Query(r)
+	if len(r.Question) == 1 {
+		switch r.Question[0].Qtype {
+		case dns.TypeAXFR, dns.TypeIXFR:
+			if _, ok := w.RemoteAddr().(*net.TCPAddr); ok {
+				t.serveTransfer(w, r)
+				return
+			}
+		}
+	}
+	res, err := t.QueryFrom(r, w.RemoteAddr())
 	if nil != err {
 		res = &dns.Msg{}
 		res.SetReply(r)
@@ -284,6 +1477,46 @@ func (t *TrustedDNS) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	w.WriteMsg(res)
 }
 
+// serveTransfer proxies an AXFR/IXFR request to the selected trusted upstream over TCP,
+// streaming the zone back to the requester envelope by envelope as it arrives, so the
+// trusted-DNS policy engine can front zone transfers too.
+//
+// Zone transfers speak plain DNS-over-TCP; dns.Transfer has no notion of TLS, HTTP or
+// QUIC framing, so only udp/tcp ServerConfigs are eligible here. A TrustedDNS configured
+// exclusively with tls://, https:// or quic:// upstreams can't proxy transfers at all.
+func (t *TrustedDNS) serveTransfer(w dns.ResponseWriter, r *dns.Msg) {
+	server := selectPlainDNSServer(t.Config.TrustedDNS)
+	if nil == server {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+	var c net.Conn
+	var err error
+	if nil != t.Config.DialTimeout {
+		c, err = t.Config.DialTimeout("tcp", server.addr, server.timeout)
+	} else {
+		c, err = net.DialTimeout("tcp", server.addr, server.timeout)
+	}
+	if nil != err {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+	defer c.Close()
+	tr := &dns.Transfer{Conn: &dns.Conn{Conn: c}}
+	envelopes, err := tr.In(r, server.addr)
+	if nil != err {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+		return
+	}
+	tr.Out(w, r, envelopes)
+}
+
 func (t *TrustedDNS) Start() error {
 	return dns.ListenAndServe(t.Config.Listen, "udp", t)
 }
@@ -320,6 +1553,18 @@ func NewTrustedDNS(conf *Config) (*TrustedDNS, error) {
 	}
 	for i := range s.Config.TrustedDNS {
 		s.Config.TrustedDNS[i].init()
+		if nil != s.Config.TrustedDNS[i].Bootstrap {
+			s.Config.TrustedDNS[i].Bootstrap.init()
+		}
+	}
+	for i := range s.Config.FastDNS {
+		if nil != s.Config.FastDNS[i].Bootstrap {
+			s.Config.FastDNS[i].Bootstrap.init()
+		}
+	}
+	if s.Config.CacheSize > 0 {
+		s.cache = newDNSCache(s.Config.CacheSize)
+		s.startPrefetch()
 	}
 	//log.Printf("%v", s.Config)
 	return s, nil